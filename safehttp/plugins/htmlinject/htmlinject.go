@@ -33,10 +33,23 @@ type Rule struct {
 	// WithAttributes is a filter applied on tags to decide whether to run the Rule:
 	// only tags with the given attributes key:value will be matched.
 	WithAttributes map[string]string
+	// Selector is a CSS-selector-like expression used to trigger the rule, e.g.
+	// `form[method="post"]:not([data-no-xsrf])` or `head > link[rel=stylesheet]`.
+	// It supports type selectors, id/class shortcuts, attribute selectors
+	// (=, ~=, |=, ^=, $=, *= and bare existence), :not(...) and the
+	// descendant/child combinators, matched against an ancestor stack maintained
+	// while walking the template. Selector is mutually exclusive with OnTag and
+	// WithAttributes.
+	Selector string
 	// AddAttributes is a list of strings to add to the HTML as attributes.
 	// All the given strings will be appended verbatim after the matched tag so they
 	// should be prefixed with a space.
 	AddAttributes []string
+	// AddAttributesFunc is like AddAttributes but computes the attributes to
+	// add from the matched tag's existing attributes, e.g. to compute a
+	// Subresource Integrity hash from a tag's src/href. It runs after
+	// AddAttributes. Returning a nil slice and a nil error adds nothing.
+	AddAttributesFunc func(attrs map[string]string) ([]string, error)
 	// AddNodes is a list of nodes to append immediately after the opening tag that matched.
 	// This means that for elements that have a matching closing tag the added node will be
 	// a child node, for self-closing tags it will be a sibling.
@@ -95,43 +108,116 @@ func XSRFTokens(inputTag string) Config {
 		AddNodes: []string{inputTag}}}
 }
 
-// Transform rewrites the given template according to the given configs.
-// If the passed io.Rewriter has a `Size() int64` method it will be used to pre-allocate buffers.
-func Transform(src io.Reader, cfg ...Config) (string, error) {
+// Transform rewrites the given template according to the given Configs and
+// TransformOptions (e.g. Minify). If the passed io.Reader has a `Size() int64`
+// method it will be used to pre-allocate buffers. The whole rewritten template
+// is buffered in memory; for large templates, or to rewrite as bytes are
+// produced, use TransformTo instead.
+func Transform(src io.Reader, opts ...TransformOption) (string, error) {
+	var out strings.Builder
+	if sizer, ok := src.(interface{ Size() int64 }); ok {
+		out.Grow(int(sizer.Size()))
+	}
+	if _, err := TransformTo(&out, src, opts...); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// TransformTo rewrites src according to the given Configs and TransformOptions,
+// writing rewritten bytes to dst as they're produced by the underlying
+// html.Tokenizer rather than buffering the whole template in memory. It
+// returns the number of bytes written to dst.
+func TransformTo(dst io.Writer, src io.Reader, opts ...TransformOption) (int64, error) {
 	rw := rewriter{
 		rules:     map[string][]Rule{},
 		tokenizer: html.NewTokenizer(src),
-		out:       &strings.Builder{},
+		out:       &countingWriter{w: dst},
 	}
-	if sizer, ok := src.(interface{ Size() int64 }); ok {
-		rw.out.Grow(int(sizer.Size()))
-	}
-	for _, c := range cfg {
-		for _, r := range c {
-			rw.rules[r.OnTag] = append(rw.rules[r.OnTag], r)
+	for _, o := range opts {
+		if err := o.apply(&rw); err != nil {
+			return rw.out.n, err
 		}
 	}
 	if err := rw.rewrite(); err != nil {
-		return "", err
+		return rw.out.n, err
+	}
+	return rw.out.n, nil
+}
+
+// countingWriter wraps an io.Writer, tracking the number of bytes written to
+// it so TransformTo can report its result without requiring dst to expose one.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) WriteString(s string) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	if sw, ok := c.w.(io.StringWriter); ok {
+		n, err = sw.WriteString(s)
+	} else {
+		n, err = c.w.Write([]byte(s))
 	}
-	return rw.out.String(), nil
+	c.n += int64(n)
+	return n, err
+}
+
+// selectorRule pairs a Rule with its compiled Selector, for rules that are
+// triggered by a CSS selector rather than a plain OnTag match.
+type selectorRule struct {
+	sel  compiledSelector
+	rule Rule
 }
 
 type rewriter struct {
 	// tag -> rules for that tag
-	rules     map[string][]Rule
+	rules map[string][]Rule
+	// rules triggered by a Rule.Selector instead of OnTag
+	selectorRules []selectorRule
+	// ancestors is the stack of still-open tags, outermost first, used to
+	// evaluate descendant/child selectors.
+	ancestors []tagFrame
+	// minify holds the options passed to Minify, or nil if minification is disabled.
+	minify    *MinifyOptions
 	tokenizer *html.Tokenizer
-	out       *strings.Builder
+	out       *countingWriter
+}
+
+// addRule registers a Rule, compiling its Selector if set.
+func (r *rewriter) addRule(rule Rule) error {
+	if rule.Selector != "" {
+		if rule.OnTag != "" || len(rule.WithAttributes) > 0 {
+			return fmt.Errorf("rule %q: Selector is mutually exclusive with OnTag/WithAttributes", rule.Name)
+		}
+		sel, err := parseSelector(rule.Selector)
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		r.selectorRules = append(r.selectorRules, selectorRule{sel: sel, rule: rule})
+		return nil
+	}
+	r.rules[rule.OnTag] = append(r.rules[rule.OnTag], rule)
+	return nil
 }
 
 // emitRaw copies the current raw token to the output.
-func (r rewriter) emitRaw() error {
+func (r *rewriter) emitRaw() error {
 	_, err := r.out.Write(r.tokenizer.Raw())
 	return err
 }
 
 // rewrite runs the rewriter.
-func (r rewriter) rewrite() error {
+func (r *rewriter) rewrite() error {
 	for {
 		switch tkn := r.tokenizer.Next(); tkn {
 		case html.ErrorToken:
@@ -140,8 +226,35 @@ func (r rewriter) rewrite() error {
 			}
 			// We got EOF, let's just emit the last token and exit.
 			return r.emitRaw()
-		case html.StartTagToken, html.SelfClosingTagToken:
-			if err := r.processTag(); err != nil {
+		case html.StartTagToken:
+			tagname, attrs, err := r.processTag()
+			if err != nil {
+				return err
+			}
+			if !voidElements[tagname] {
+				r.ancestors = append(r.ancestors, tagFrame{tag: tagname, attrs: attrs})
+			}
+		case html.SelfClosingTagToken:
+			if _, _, err := r.processTag(); err != nil {
+				return err
+			}
+		case html.EndTagToken:
+			tag, _ := r.tokenizer.TagName()
+			if n := len(r.ancestors); n > 0 && r.ancestors[n-1].tag == string(tag) {
+				r.ancestors = r.ancestors[:n-1]
+			}
+			if err := r.emitRaw(); err != nil {
+				return err
+			}
+		case html.TextToken:
+			if err := r.emitText(); err != nil {
+				return err
+			}
+		case html.CommentToken:
+			if r.minify != nil && r.minify.Comments && !isPreservedComment(r.tokenizer.Text()) {
+				continue
+			}
+			if err := r.emitRaw(); err != nil {
 				return err
 			}
 		default:
@@ -152,7 +265,9 @@ func (r rewriter) rewrite() error {
 	}
 }
 
-func (r rewriter) processTag() error {
+// processTag rewrites the current start/self-closing tag, returning its name
+// and attributes so the caller can maintain the ancestor stack.
+func (r *rewriter) processTag() (string, map[string]string, error) {
 	// Copy raw tokens to better formats
 	var (
 		tagname    string
@@ -173,16 +288,21 @@ func (r rewriter) processTag() error {
 	// Filter rules by attributes
 	var triggeredRules []Rule
 	{
-		for _, r := range r.rules[tagname] {
+		for _, rule := range r.rules[tagname] {
 			match := true
-			for k, v := range r.WithAttributes {
+			for k, v := range rule.WithAttributes {
 				if attributes[k] != v {
 					match = false
 					break
 				}
 			}
 			if match {
-				triggeredRules = append(triggeredRules, r)
+				triggeredRules = append(triggeredRules, rule)
+			}
+		}
+		for _, sr := range r.selectorRules {
+			if sr.sel.match(r.ancestors, tagname, attributes) {
+				triggeredRules = append(triggeredRules, sr.rule)
 			}
 		}
 	}
@@ -192,28 +312,44 @@ func (r rewriter) processTag() error {
 		attrPos := len(tagname) + 1
 		// Write the "<" symbol and the tag name, e.g. "<script"
 		if _, err := r.out.Write(raw[:attrPos]); err != nil {
-			return fmt.Errorf("copying beginning of tag: %w", err)
+			return "", nil, fmt.Errorf("copying beginning of tag: %w", err)
 		}
 		// Write the attributes we have to add
 		for _, rule := range triggeredRules {
 			for _, attr := range rule.AddAttributes {
 				if _, err := r.out.WriteString(attr); err != nil {
-					return fmt.Errorf("executing rule %q: %w", rule.Name, err)
+					return "", nil, fmt.Errorf("executing rule %q: %w", rule.Name, err)
+				}
+			}
+			if rule.AddAttributesFunc == nil {
+				continue
+			}
+			extra, err := rule.AddAttributesFunc(attributes)
+			if err != nil {
+				return "", nil, fmt.Errorf("executing rule %q: %w", rule.Name, err)
+			}
+			for _, attr := range extra {
+				if _, err := r.out.WriteString(attr); err != nil {
+					return "", nil, fmt.Errorf("executing rule %q: %w", rule.Name, err)
 				}
 			}
 		}
 		// Write the rest of the opening tag, e.g. ` src="foo.js">`
-		if _, err := r.out.Write(raw[attrPos:]); err != nil {
-			return fmt.Errorf("copying end of tag: %w", err)
+		rest := raw[attrPos:]
+		if r.minify != nil && r.minify.Quotes {
+			rest = minifyQuotes(rest)
+		}
+		if _, err := r.out.Write(rest); err != nil {
+			return "", nil, fmt.Errorf("copying end of tag: %w", err)
 		}
 		// Write the nodes we have to add
 		for _, rule := range triggeredRules {
 			for _, node := range rule.AddNodes {
 				if _, err := r.out.WriteString(node); err != nil {
-					return fmt.Errorf("executing rule %q: %w", rule.Name, err)
+					return "", nil, fmt.Errorf("executing rule %q: %w", rule.Name, err)
 				}
 			}
 		}
 	}
-	return nil
+	return tagname, attributes, nil
 }
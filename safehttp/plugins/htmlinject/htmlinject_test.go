@@ -71,7 +71,7 @@ Last name:<br>
 func BenchmarkTransform(b *testing.B) {
 	b.ReportAllocs()
 	var (
-		config = []Config{CSPNoncesDefault, XSRFTokensDefault}
+		config = []TransformOption{CSPNoncesDefault, XSRFTokensDefault}
 		in     = `
 <html>
 <head>
@@ -120,6 +120,7 @@ func TestTransform(t *testing.T) {
 	var tests = []struct {
 		name     string
 		config   []Config
+		opts     []TransformOption
 		in, want string
 	}{
 		{
@@ -193,6 +194,45 @@ h1 {
   Last name:<br>
   <input type="text" name="lastname">
 </form>
+`,
+		},
+		{
+			name: "selector-based rule",
+			config: []Config{{
+				Rule{
+					Name:          "nonce for preload scripts only",
+					Selector:      `link[rel~="preload"][as="script"]`,
+					AddAttributes: []string{` nonce="secret"`},
+				},
+				Rule{
+					Name:          "SRI for stylesheets not opted out",
+					Selector:      `head > link[rel="stylesheet"]:not([data-no-sri])`,
+					AddAttributes: []string{` integrity="sha384-xyz"`},
+				},
+			}},
+			in: `
+<html>
+<head>
+<link rel="stylesheet" href="styles.css">
+<link rel="stylesheet" href="vendor.css" data-no-sri>
+<link rel=preload as="script" src="gopher.js">
+</head>
+<body>
+<div><link rel="stylesheet" href="nested.css"></div>
+</body>
+</html>
+`,
+			want: `
+<html>
+<head>
+<link integrity="sha384-xyz" rel="stylesheet" href="styles.css">
+<link rel="stylesheet" href="vendor.css" data-no-sri>
+<link nonce="secret" rel=preload as="script" src="gopher.js">
+</head>
+<body>
+<div><link rel="stylesheet" href="nested.css"></div>
+</body>
+</html>
 `,
 		},
 		{
@@ -231,12 +271,65 @@ h1 {
 </form>
 </body>
 </html>
+`,
+		},
+		{
+			name: "minify whitespace, comments and quotes",
+			opts: []TransformOption{Minify(MinifyOptions{Whitespace: true, Comments: true, Quotes: true})},
+			in: `
+<html>
+<!-- a regular comment -->
+<!--[if IE]>
+<link rel="stylesheet" href="ie.css">
+<![endif]-->
+<body class="home" disabled="disabled">
+  Hello    world
+  <pre>  keep   me  </pre>
+</body>
+</html>
+`,
+			want: ` <html>  <!--[if IE]>
+<link rel="stylesheet" href="ie.css">
+<![endif]--> <body class=home disabled> Hello world <pre>  keep   me  </pre> </body> </html> `,
+		},
+		{
+			name:   "minify preserves template actions",
+			config: []Config{CSPNoncesDefault},
+			opts:   []TransformOption{Minify(MinifyOptions{Whitespace: true, Quotes: true})},
+			in: `
+<script type="application/javascript">alert("script")</script>
+<a href="{{.URL}}">  {{.Text}}  </a>
+`,
+			want: ` <script nonce="{{CSPNonce}}" type=application/javascript>alert("script")</script> <a href="{{.URL}}">  {{.Text}}  </a> `,
+		},
+		{
+			name: "SRI injection",
+			config: []Config{SRI(SRIManifest{
+				"app.js":     "sha384-abc",
+				"styles.css": "sha384-def",
+			})},
+			in: `
+<script src="app.js"></script>
+<script>inline()</script>
+<link rel="stylesheet" href="styles.css">
+<link rel="stylesheet" href="unknown.css">
+`,
+			want: `
+<script integrity="sha384-abc" crossorigin="anonymous" src="app.js"></script>
+<script>inline()</script>
+<link integrity="sha384-def" crossorigin="anonymous" rel="stylesheet" href="styles.css">
+<link rel="stylesheet" href="unknown.css">
 `,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := Transform(strings.NewReader(tt.in), tt.config...)
+			var opts []TransformOption
+			for _, c := range tt.config {
+				opts = append(opts, c)
+			}
+			opts = append(opts, tt.opts...)
+			got, err := Transform(strings.NewReader(tt.in), opts...)
 			if err != nil {
 				t.Fatalf("Transform: got err %q, didn't want one", err)
 			}
@@ -0,0 +1,251 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htmlinject
+
+import (
+	"bytes"
+	"strings"
+)
+
+// TransformOption configures a single Transform/TransformTo call. Unlike a
+// Config, which contributes Rules, a TransformOption can also switch on
+// cross-cutting passes such as minification. Config itself implements
+// TransformOption, so existing calls passing only Configs keep working.
+type TransformOption interface {
+	apply(rw *rewriter) error
+}
+
+func (c Config) apply(rw *rewriter) error {
+	for _, rule := range c {
+		if err := rw.addRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MinifyOptions selects which minification passes Minify applies. Every pass
+// is opt-in so that users on a strict CSP can avoid anything that would alter
+// script/style bodies.
+type MinifyOptions struct {
+	// Whitespace collapses runs of whitespace in text nodes outside of
+	// <pre>, <textarea>, <script> and <style> down to a single space.
+	Whitespace bool
+	// Comments strips HTML comments, except IE conditional comments
+	// (`<!--[if ...]> ... <![endif]-->`) and comments that contain a
+	// template action.
+	Comments bool
+	// Quotes removes quotes around attribute values when it's safe to do so,
+	// and collapses boolean attributes (e.g. `disabled="disabled"`) down to
+	// their bare name.
+	Quotes bool
+}
+
+type minifyOption struct{ opts MinifyOptions }
+
+func (m minifyOption) apply(rw *rewriter) error {
+	rw.minify = &m.opts
+	return nil
+}
+
+// Minify returns a TransformOption that enables the requested minification
+// passes for a single Transform/TransformTo call. It minifies by walking the
+// same token stream used to apply Rules, so `{{CSPNonce}}`-style template
+// actions injected by a Rule are always preserved verbatim, as is any
+// attribute value or text node whose raw bytes already contain one.
+func Minify(opts MinifyOptions) TransformOption {
+	return minifyOption{opts: opts}
+}
+
+// rawTextTags are elements whose content must never be touched by the
+// whitespace pass: either because whitespace there is significant (pre,
+// textarea) or because the tokenizer already hands us their content as a
+// single opaque text token (script, style).
+var rawTextTags = map[string]bool{
+	"pre": true, "textarea": true, "script": true, "style": true,
+}
+
+// inRawTextContext reports whether any open ancestor is one of rawTextTags, so
+// that e.g. text inside <pre><code>...</code></pre> is left untouched too.
+func (r *rewriter) inRawTextContext() bool {
+	for _, a := range r.ancestors {
+		if rawTextTags[a.tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// emitText writes the current TextToken, collapsing whitespace first if the
+// Whitespace minify pass is enabled and applicable.
+func (r *rewriter) emitText() error {
+	raw := r.tokenizer.Raw()
+	if r.minify != nil && r.minify.Whitespace && !r.inRawTextContext() && !bytes.Contains(raw, []byte("{{")) {
+		raw = collapseWhitespace(raw)
+	}
+	_, err := r.out.Write(raw)
+	return err
+}
+
+// collapseWhitespace replaces every run of ASCII whitespace with a single space.
+func collapseWhitespace(raw []byte) []byte {
+	out := make([]byte, 0, len(raw))
+	inWS := false
+	for _, c := range raw {
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' {
+			inWS = true
+			continue
+		}
+		if inWS {
+			out = append(out, ' ')
+			inWS = false
+		}
+		out = append(out, c)
+	}
+	if inWS {
+		out = append(out, ' ')
+	}
+	return out
+}
+
+// isPreservedComment reports whether a comment's text must survive the
+// Comments minify pass untouched: IE conditional comments and comments that
+// embed a template action.
+func isPreservedComment(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("[if")) || bytes.Contains(data, []byte("<![endif]")) {
+		return true
+	}
+	if bytes.Contains(data, []byte("{{")) && bytes.Contains(data, []byte("}}")) {
+		return true
+	}
+	return false
+}
+
+// booleanAttributes lists the standard HTML boolean attributes, whose mere
+// presence means "true" regardless of their value.
+var booleanAttributes = map[string]bool{
+	"allowfullscreen": true, "async": true, "autofocus": true, "autoplay": true,
+	"checked": true, "controls": true, "default": true, "defer": true,
+	"disabled": true, "formnovalidate": true, "hidden": true, "ismap": true,
+	"itemscope": true, "loop": true, "multiple": true, "muted": true,
+	"nomodule": true, "novalidate": true, "open": true, "readonly": true,
+	"required": true, "reversed": true, "selected": true,
+}
+
+// minifyQuotes rewrites the attribute/close portion of a start tag (everything
+// after the tag name), unquoting attribute values when it's safe and
+// collapsing boolean attributes down to their bare name. Values containing a
+// template action are left untouched.
+func minifyQuotes(raw []byte) []byte {
+	var out bytes.Buffer
+	i, n := 0, len(raw)
+	for i < n {
+		c := raw[i]
+		if c == '>' || (c == '/' && i+1 < n && raw[i+1] == '>') {
+			out.Write(raw[i:])
+			break
+		}
+		if isHTMLSpace(c) {
+			out.WriteByte(c)
+			i++
+			continue
+		}
+		start := i
+		for i < n && raw[i] != '=' && !isHTMLSpace(raw[i]) && raw[i] != '>' && raw[i] != '/' {
+			i++
+		}
+		if i == start && c == '/' {
+			// A `/` that doesn't close the tag, e.g. `<br/ >`.
+			out.WriteByte(c)
+			i++
+			continue
+		}
+		name := string(raw[start:i])
+
+		j := i
+		for j < n && isHTMLSpace(raw[j]) {
+			j++
+		}
+		if j >= n || raw[j] != '=' {
+			// Valueless attribute, e.g. `disabled`.
+			out.Write(raw[start:i])
+			continue
+		}
+		j++
+		for j < n && isHTMLSpace(raw[j]) {
+			j++
+		}
+		if j >= n {
+			out.Write(raw[start:i])
+			i = j
+			continue
+		}
+		quote := raw[j]
+		if quote != '"' && quote != '\'' {
+			for j < n && !isHTMLSpace(raw[j]) && raw[j] != '>' {
+				j++
+			}
+			out.Write(raw[start:j])
+			i = j
+			continue
+		}
+		vstart := j + 1
+		vend := bytes.IndexByte(raw[vstart:], quote)
+		if vend < 0 {
+			out.Write(raw[start:])
+			i = n
+			continue
+		}
+		vend += vstart
+		value := string(raw[vstart:vend])
+		i = vend + 1
+
+		switch {
+		case strings.Contains(value, "{{") || strings.Contains(value, "}}"):
+			out.Write(raw[start:i])
+		case booleanAttributes[strings.ToLower(name)] && (value == "" || strings.EqualFold(value, name)):
+			out.WriteString(name)
+		case isSafeUnquoted(value) && !(i < n && raw[i] == '/'):
+			// An unquoted value directly followed by `/>` would absorb the
+			// `/`, so such values keep their quotes.
+			out.WriteString(name)
+			out.WriteByte('=')
+			out.WriteString(value)
+		default:
+			out.Write(raw[start:i])
+		}
+	}
+	return out.Bytes()
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// isSafeUnquoted reports whether value can be written as an unquoted HTML
+// attribute value without changing its meaning.
+func isSafeUnquoted(value string) bool {
+	if value == "" || strings.HasSuffix(value, "/") {
+		return false
+	}
+	for _, c := range value {
+		switch c {
+		case ' ', '\t', '\n', '\r', '\f', '"', '\'', '=', '<', '>', '`':
+			return false
+		}
+	}
+	return true
+}
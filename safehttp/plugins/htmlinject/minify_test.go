@@ -0,0 +1,151 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htmlinject
+
+import "testing"
+
+func TestCollapseWhitespace(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "single spaces untouched", in: "a b c", want: "a b c"},
+		{name: "collapses runs", in: "a    b", want: "a b"},
+		{name: "collapses mixed whitespace", in: "a \t\n\r\f b", want: "a b"},
+		{name: "leading run", in: "   a", want: " a"},
+		{name: "trailing run", in: "a   ", want: "a "},
+		{name: "all whitespace", in: "   \n\t", want: " "},
+		{name: "empty", in: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(collapseWhitespace([]byte(tt.in))); got != tt.want {
+				t.Errorf("collapseWhitespace(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPreservedComment(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want bool
+	}{
+		{name: "ie conditional", in: "[if IE]>\n<link rel=\"stylesheet\" href=\"ie.css\">\n<![endif]", want: true},
+		{name: "ie conditional with leading space", in: "  [if lt IE 9]> foo <![endif]", want: true},
+		{name: "template action", in: " {{if .X}} ", want: true},
+		{name: "regular comment", in: " a regular comment ", want: false},
+		{name: "unmatched template braces", in: " {{ not closed ", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPreservedComment([]byte(tt.in)); got != tt.want {
+				t.Errorf("isPreservedComment(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSafeUnquoted(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want bool
+	}{
+		{name: "empty", in: "", want: false},
+		{name: "plain", in: "preload", want: true},
+		{name: "path", in: "gopher.js", want: true},
+		{name: "contains space", in: "a b", want: false},
+		{name: "contains quote", in: `a"b`, want: false},
+		{name: "contains equals", in: "a=b", want: false},
+		{name: "contains angle bracket", in: "a>b", want: false},
+		{name: "trailing slash", in: "a/", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSafeUnquoted(tt.in); got != tt.want {
+				t.Errorf("isSafeUnquoted(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinifyQuotes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "unquotes safe value",
+			in:   ` rel="preload">`,
+			want: ` rel=preload>`,
+		},
+		{
+			name: "keeps quotes for value with space",
+			in:   ` alt="hello world">`,
+			want: ` alt="hello world">`,
+		},
+		{
+			name: "collapses boolean attribute with matching value",
+			in:   ` disabled="disabled">`,
+			want: ` disabled>`,
+		},
+		{
+			name: "collapses boolean attribute with empty value",
+			in:   ` disabled="">`,
+			want: ` disabled>`,
+		},
+		{
+			name: "leaves non-boolean empty value quoted",
+			in:   ` data-foo="">`,
+			want: ` data-foo="">`,
+		},
+		{
+			name: "leaves bare boolean attribute alone",
+			in:   ` disabled>`,
+			want: ` disabled>`,
+		},
+		{
+			name: "preserves template action in value",
+			in:   ` href="{{.URL}}">`,
+			want: ` href="{{.URL}}">`,
+		},
+		{
+			name: "preserves self-closing tag",
+			in:   ` rel="preload"/>`,
+			want: ` rel="preload"/>`,
+		},
+		{
+			name: "single-quoted value is unquoted too",
+			in:   ` rel='preload'>`,
+			want: ` rel=preload>`,
+		},
+		{
+			name: "multiple attributes",
+			in:   ` rel="preload" as="script" disabled="disabled">`,
+			want: ` rel=preload as=script disabled>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(minifyQuotes([]byte(tt.in))); got != tt.want {
+				t.Errorf("minifyQuotes(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
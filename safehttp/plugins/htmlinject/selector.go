@@ -0,0 +1,329 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htmlinject
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tagFrame is an entry in the ancestor stack maintained by rewriter.rewrite
+// while walking the token stream. It holds just enough information about an
+// still-open tag to evaluate selectors against it.
+type tagFrame struct {
+	tag   string
+	attrs map[string]string
+}
+
+// voidElements lists the HTML elements that never have an end tag and are
+// therefore never pushed onto the ancestor stack.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// attrMatcher matches a single CSS attribute selector, e.g. [rel~="preload"].
+// op == 0 means a bare existence check, e.g. [nonce].
+type attrMatcher struct {
+	key string
+	op  byte // 0, '=', '~', '|', '^', '$', '*'
+	val string
+}
+
+func (m attrMatcher) matches(attrs map[string]string) bool {
+	v, ok := attrs[m.key]
+	if m.op == 0 {
+		return ok
+	}
+	if !ok {
+		return false
+	}
+	switch m.op {
+	case '=':
+		return v == m.val
+	case '~':
+		for _, tok := range strings.Fields(v) {
+			if tok == m.val {
+				return true
+			}
+		}
+		return false
+	case '|':
+		return v == m.val || strings.HasPrefix(v, m.val+"-")
+	case '^':
+		return m.val != "" && strings.HasPrefix(v, m.val)
+	case '$':
+		return m.val != "" && strings.HasSuffix(v, m.val)
+	case '*':
+		return m.val != "" && strings.Contains(v, m.val)
+	}
+	return false
+}
+
+// simpleSelector is a single compound selector, e.g. `form.login:not([data-no-xsrf])`,
+// with no combinators.
+type simpleSelector struct {
+	tag   string // "" or "*" matches any tag name
+	attrs []attrMatcher
+	nots  []simpleSelector
+}
+
+func (s simpleSelector) matches(tag string, attrs map[string]string) bool {
+	if s.tag != "" && s.tag != "*" && !strings.EqualFold(s.tag, tag) {
+		return false
+	}
+	for _, m := range s.attrs {
+		if !m.matches(attrs) {
+			return false
+		}
+	}
+	for _, n := range s.nots {
+		if n.matches(tag, attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectorStep is one compound selector in a combinator chain, together with
+// the combinator that relates it to the step before it. combinator is zero
+// for the first step in the chain.
+type selectorStep struct {
+	simple     simpleSelector
+	combinator byte // 0, ' ' (descendant) or '>' (child)
+}
+
+// compiledSelector is a parsed Rule.Selector, ready to be matched against a
+// tag and its ancestor stack.
+type compiledSelector struct {
+	steps []selectorStep
+}
+
+// match reports whether the tag being processed, given its attributes and the
+// stack of still-open ancestor tags (outermost first), satisfies the selector.
+func (cs compiledSelector) match(ancestors []tagFrame, tag string, attrs map[string]string) bool {
+	if len(cs.steps) == 0 {
+		return false
+	}
+	last := cs.steps[len(cs.steps)-1]
+	if !last.simple.matches(tag, attrs) {
+		return false
+	}
+	return cs.matchFrom(len(cs.steps)-2, ancestors, len(ancestors)-1)
+}
+
+// matchFrom tries to satisfy cs.steps[0..i] against ancestors[0..stackIdx],
+// backtracking over descendant-combinator choices: picking the closest
+// matching ancestor for a given step isn't always the assignment that lets
+// the rest of the chain match, so on failure it retries with the next
+// matching ancestor further up the stack instead of giving up immediately.
+func (cs compiledSelector) matchFrom(i int, ancestors []tagFrame, stackIdx int) bool {
+	if i < 0 {
+		return true
+	}
+	step := cs.steps[i]
+	comb := cs.steps[i+1].combinator
+	if comb == '>' {
+		if stackIdx < 0 || !step.simple.matches(ancestors[stackIdx].tag, ancestors[stackIdx].attrs) {
+			return false
+		}
+		return cs.matchFrom(i-1, ancestors, stackIdx-1)
+	}
+	for j := stackIdx; j >= 0; j-- {
+		if step.simple.matches(ancestors[j].tag, ancestors[j].attrs) && cs.matchFrom(i-1, ancestors, j-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSelector compiles a CSS-like selector string into a compiledSelector.
+// It supports type selectors, id/class shortcuts, attribute selectors (=, ~=,
+// |=, ^=, $=, *= and bare existence), :not(...) and the descendant/child
+// combinators. It does not support comma-separated selector lists,
+// pseudo-elements, or sibling combinators.
+func parseSelector(sel string) (compiledSelector, error) {
+	parts, combs, err := splitCombinators(sel)
+	if err != nil {
+		return compiledSelector{}, fmt.Errorf("selector %q: %w", sel, err)
+	}
+	steps := make([]selectorStep, len(parts))
+	for i, p := range parts {
+		ss, err := parseCompound(p)
+		if err != nil {
+			return compiledSelector{}, fmt.Errorf("selector %q: %w", sel, err)
+		}
+		steps[i] = selectorStep{simple: ss, combinator: combs[i]}
+	}
+	return compiledSelector{steps: steps}, nil
+}
+
+// splitCombinators splits a selector into its compound-selector parts and the
+// combinator that precedes each one (the first entry's combinator is always 0).
+func splitCombinators(sel string) ([]string, []byte, error) {
+	var (
+		parts       []string
+		combs       []byte
+		buf         strings.Builder
+		depth       int
+		pendingComb byte
+	)
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		parts = append(parts, buf.String())
+		combs = append(combs, pendingComb)
+		buf.Reset()
+		pendingComb = ' '
+	}
+	for i := 0; i < len(sel); i++ {
+		c := sel[i]
+		switch {
+		case c == '[' || c == '(':
+			depth++
+			buf.WriteByte(c)
+		case c == ']' || c == ')':
+			depth--
+			if depth < 0 {
+				return nil, nil, fmt.Errorf("unbalanced brackets")
+			}
+			buf.WriteByte(c)
+		case depth == 0 && c == '>':
+			flush()
+			pendingComb = '>'
+		case depth == 0 && (c == ' ' || c == '\t' || c == '\n'):
+			flush()
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+	if depth != 0 {
+		return nil, nil, fmt.Errorf("unbalanced brackets")
+	}
+	if len(parts) == 0 {
+		return nil, nil, fmt.Errorf("empty selector")
+	}
+	combs[0] = 0
+	return parts, combs, nil
+}
+
+// parseCompound parses a single compound selector, e.g. `link[rel~="preload"][as="script"]`.
+func parseCompound(s string) (simpleSelector, error) {
+	var ss simpleSelector
+	i, n := 0, len(s)
+	start := i
+	for i < n && s[i] != '.' && s[i] != '#' && s[i] != '[' && s[i] != ':' {
+		i++
+	}
+	ss.tag = s[start:i]
+	for i < n {
+		switch s[i] {
+		case '.':
+			j := nextSpecial(s, i+1)
+			ss.attrs = append(ss.attrs, attrMatcher{key: "class", op: '~', val: s[i+1 : j]})
+			i = j
+		case '#':
+			j := nextSpecial(s, i+1)
+			ss.attrs = append(ss.attrs, attrMatcher{key: "id", op: '=', val: s[i+1 : j]})
+			i = j
+		case '[':
+			j := strings.IndexByte(s[i:], ']')
+			if j < 0 {
+				return ss, fmt.Errorf("unterminated attribute selector in %q", s)
+			}
+			j += i
+			m, err := parseAttr(s[i+1 : j])
+			if err != nil {
+				return ss, err
+			}
+			ss.attrs = append(ss.attrs, m)
+			i = j + 1
+		case ':':
+			const notPrefix = ":not("
+			if !strings.HasPrefix(s[i:], notPrefix) {
+				return ss, fmt.Errorf("unsupported pseudo-class in %q", s)
+			}
+			j := strings.IndexByte(s[i:], ')')
+			if j < 0 {
+				return ss, fmt.Errorf("unterminated :not() in %q", s)
+			}
+			j += i
+			inner, err := parseCompound(s[i+len(notPrefix) : j])
+			if err != nil {
+				return ss, err
+			}
+			ss.nots = append(ss.nots, inner)
+			i = j + 1
+		default:
+			return ss, fmt.Errorf("unexpected character %q in selector %q", string(s[i]), s)
+		}
+	}
+	return ss, nil
+}
+
+// nextSpecial returns the index of the next selector-special character at or
+// after i, or len(s) if there is none.
+func nextSpecial(s string, i int) int {
+	for i < len(s) && s[i] != '.' && s[i] != '#' && s[i] != '[' && s[i] != ':' {
+		i++
+	}
+	return i
+}
+
+// parseAttr parses the content of an attribute selector, without the
+// enclosing brackets, e.g. `rel~="preload"` or `data-no-xsrf`. The operator is
+// located by scanning forward from the attribute name, rather than searching
+// for it anywhere in s, so that a quoted value containing a literal "~=" (or
+// any other operator token) can't be mistaken for the real separator.
+func parseAttr(s string) (attrMatcher, error) {
+	if s == "" {
+		return attrMatcher{}, fmt.Errorf("empty attribute selector")
+	}
+	i := 0
+	for i < len(s) && !isAttrOperatorByte(s[i]) {
+		i++
+	}
+	key := s[:i]
+	if key == "" {
+		return attrMatcher{}, fmt.Errorf("missing attribute name in %q", s)
+	}
+	if i >= len(s) {
+		// Bare existence check, e.g. [nonce].
+		return attrMatcher{key: key}, nil
+	}
+	opb := s[i]
+	eq := i
+	if s[i] != '=' {
+		eq++
+		if eq >= len(s) || s[eq] != '=' {
+			return attrMatcher{}, fmt.Errorf("invalid attribute selector operator in %q", s)
+		}
+	}
+	val := strings.Trim(s[eq+1:], `"'`)
+	return attrMatcher{key: key, op: opb, val: val}, nil
+}
+
+// isAttrOperatorByte reports whether c can start an attribute selector
+// operator (=, ~=, |=, ^=, $=, *=).
+func isAttrOperatorByte(c byte) bool {
+	switch c {
+	case '=', '~', '|', '^', '$', '*':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htmlinject
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAttr(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    attrMatcher
+		wantErr bool
+	}{
+		{name: "bare existence", in: "nonce", want: attrMatcher{key: "nonce"}},
+		{name: "equals", in: `rel=stylesheet`, want: attrMatcher{key: "rel", op: '=', val: "stylesheet"}},
+		{name: "equals quoted", in: `rel="stylesheet"`, want: attrMatcher{key: "rel", op: '=', val: "stylesheet"}},
+		{name: "includes", in: `rel~="preload"`, want: attrMatcher{key: "rel", op: '~', val: "preload"}},
+		{name: "dash match", in: `lang|="en"`, want: attrMatcher{key: "lang", op: '|', val: "en"}},
+		{name: "prefix", in: `href^="https://"`, want: attrMatcher{key: "href", op: '^', val: "https://"}},
+		{name: "suffix", in: `src$=".js"`, want: attrMatcher{key: "src", op: '$', val: ".js"}},
+		{name: "contains", in: `class*="btn"`, want: attrMatcher{key: "class", op: '*', val: "btn"}},
+		{
+			// Regression test: a quoted value that itself contains an
+			// operator token must not be mistaken for the real separator.
+			name: "value contains operator token",
+			in:   `data-sig="~=foo"`,
+			want: attrMatcher{key: "data-sig", op: '=', val: "~=foo"},
+		},
+		{
+			name: "value contains a different operator token",
+			in:   `data-sig="a^=b|=c"`,
+			want: attrMatcher{key: "data-sig", op: '=', val: "a^=b|=c"},
+		},
+		{name: "empty", in: "", wantErr: true},
+		{name: "missing name", in: `="foo"`, wantErr: true},
+		{name: "bogus operator", in: `rel~foo`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAttr(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAttr(%q): got err %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(attrMatcher{})); diff != "" {
+				t.Errorf("parseAttr(%q): -want +got %s", tt.in, diff)
+			}
+		})
+	}
+}
+
+func TestParseCompound(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    simpleSelector
+		wantErr bool
+	}{
+		{name: "tag only", in: "form", want: simpleSelector{tag: "form"}},
+		{name: "wildcard", in: "*", want: simpleSelector{tag: "*"}},
+		{
+			name: "class shortcut",
+			in:   "form.login",
+			want: simpleSelector{tag: "form", attrs: []attrMatcher{{key: "class", op: '~', val: "login"}}},
+		},
+		{
+			name: "id shortcut",
+			in:   "#main",
+			want: simpleSelector{attrs: []attrMatcher{{key: "id", op: '=', val: "main"}}},
+		},
+		{
+			name: "multiple attribute selectors",
+			in:   `link[rel~="preload"][as="script"]`,
+			want: simpleSelector{tag: "link", attrs: []attrMatcher{
+				{key: "rel", op: '~', val: "preload"},
+				{key: "as", op: '=', val: "script"},
+			}},
+		},
+		{
+			name: "not",
+			in:   `script:not([nonce])`,
+			want: simpleSelector{tag: "script", nots: []simpleSelector{{attrs: []attrMatcher{{key: "nonce"}}}}},
+		},
+		{name: "unterminated attribute", in: `link[rel`, wantErr: true},
+		{name: "unterminated not", in: `script:not([nonce]`, wantErr: true},
+		{name: "unsupported pseudo-class", in: `a:hover`, wantErr: true},
+		{name: "unexpected character", in: `link[rel]>extra`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCompound(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCompound(%q): got err %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(simpleSelector{}, attrMatcher{})); diff != "" {
+				t.Errorf("parseCompound(%q): -want +got %s", tt.in, diff)
+			}
+		})
+	}
+}
+
+func TestSplitCombinators(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		wantParts []string
+		wantCombs []byte
+		wantErr   bool
+	}{
+		{name: "single", in: "form", wantParts: []string{"form"}, wantCombs: []byte{0}},
+		{
+			name:      "descendant",
+			in:        `form input`,
+			wantParts: []string{"form", "input"},
+			wantCombs: []byte{0, ' '},
+		},
+		{
+			name:      "child",
+			in:        `head > link[rel=stylesheet]`,
+			wantParts: []string{"head", "link[rel=stylesheet]"},
+			wantCombs: []byte{0, '>'},
+		},
+		{
+			name:      "space inside attribute value is not a combinator",
+			in:        `form[data-label="log in"] input`,
+			wantParts: []string{`form[data-label="log in"]`, "input"},
+			wantCombs: []byte{0, ' '},
+		},
+		{name: "empty", in: "", wantErr: true},
+		{name: "unbalanced", in: "form[rel", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, combs, err := splitCombinators(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitCombinators(%q): got err %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.wantParts, parts); diff != "" {
+				t.Errorf("parts: -want +got %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantCombs, combs); diff != "" {
+				t.Errorf("combinators: -want +got %s", diff)
+			}
+		})
+	}
+}
+
+func TestCompiledSelectorMatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		sel       string
+		ancestors []tagFrame
+		tag       string
+		attrs     map[string]string
+		want      bool
+	}{
+		{
+			name: "child combinator matches direct parent",
+			sel:  "head > link",
+			ancestors: []tagFrame{
+				{tag: "html"},
+				{tag: "head"},
+			},
+			tag:  "link",
+			want: true,
+		},
+		{
+			name: "child combinator rejects non-direct parent",
+			sel:  "head > link",
+			ancestors: []tagFrame{
+				{tag: "html"},
+				{tag: "head"},
+				{tag: "div"},
+			},
+			tag:  "link",
+			want: false,
+		},
+		{
+			name: "descendant combinator matches any ancestor",
+			sel:  "form input",
+			ancestors: []tagFrame{
+				{tag: "body"},
+				{tag: "form", attrs: map[string]string{"method": "post"}},
+				{tag: "div"},
+			},
+			tag:  "input",
+			want: true,
+		},
+		{
+			name:  "not excludes attribute match",
+			sel:   `form:not([data-no-xsrf])`,
+			attrs: map[string]string{"data-no-xsrf": ""},
+			tag:   "form",
+			want:  false,
+		},
+		{
+			// Regression test: a 3-part chain needs to backtrack over which
+			// ancestor satisfies the descendant step. The closest "b" (index
+			// 4) doesn't have "a" as its direct parent, but the "b" at index
+			// 1 does, and "c" is still a descendant of it.
+			name: "three-part chain requires backtracking over descendant choice",
+			sel:  "a > b c",
+			ancestors: []tagFrame{
+				{tag: "a"},
+				{tag: "b"},
+				{tag: "z"},
+				{tag: "w"},
+				{tag: "b"},
+			},
+			tag:  "c",
+			want: true,
+		},
+		{
+			name: "three-part chain with no valid assignment still fails",
+			sel:  "a > b c",
+			ancestors: []tagFrame{
+				{tag: "z"},
+				{tag: "b"},
+				{tag: "w"},
+				{tag: "b"},
+			},
+			tag:  "c",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, err := parseSelector(tt.sel)
+			if err != nil {
+				t.Fatalf("parseSelector(%q): %v", tt.sel, err)
+			}
+			if got := cs.match(tt.ancestors, tt.tag, tt.attrs); got != tt.want {
+				t.Errorf("match(%q): got %v, want %v", tt.sel, got, tt.want)
+			}
+		})
+	}
+}
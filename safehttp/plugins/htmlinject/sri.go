@@ -0,0 +1,134 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htmlinject
+
+import "fmt"
+
+// SRIFetcher resolves the Subresource Integrity hash for a resource URL.
+// Implementations can be a precomputed build-time manifest (SRIManifest) or a
+// runtime resolver that computes and caches the hash itself (SRIResolverFunc).
+type SRIFetcher interface {
+	// Hash returns the "sha384-..." integrity value for the given resource
+	// URL, and false if no hash is available for it.
+	Hash(url string) (hash string, ok bool)
+}
+
+// SRIManifest is an SRIFetcher backed by a precomputed build-time manifest
+// mapping a resource URL to its "sha384-..." integrity value.
+type SRIManifest map[string]string
+
+// Hash implements SRIFetcher.
+func (m SRIManifest) Hash(url string) (string, bool) {
+	h, ok := m[url]
+	return h, ok
+}
+
+// SRIResolverFunc adapts a plain function into an SRIFetcher, for runtime
+// resolvers that compute the hash on first use. Callers that want to avoid
+// recomputing the hash on every Transform call should cache inside f.
+type SRIResolverFunc func(url string) (hash string, ok bool)
+
+// Hash implements SRIFetcher.
+func (f SRIResolverFunc) Hash(url string) (string, bool) { return f(url) }
+
+// sriOptions holds the options configured via SRIOption.
+type sriOptions struct {
+	failOnMissingHash bool
+}
+
+// SRIOption configures SRI.
+type SRIOption func(*sriOptions)
+
+// SRIFailOnMissingHash makes SRI fail the whole Transform when a matched tag's
+// resource has no hash available from the fetcher. Without it, such tags are
+// left untouched.
+func SRIFailOnMissingHash() SRIOption {
+	return func(o *sriOptions) { o.failOnMissingHash = true }
+}
+
+// SRI constructs a Config that injects integrity="sha384-…" and
+// crossorigin="anonymous" attributes onto <script src=…>, <link
+// rel="stylesheet" href=…> and <link rel="preload" as="script|style" href=…>
+// tags, using hashes resolved by fetcher. By default a tag whose resource has
+// no available hash is left untouched; pass SRIFailOnMissingHash to fail the
+// Transform instead.
+func SRI(fetcher SRIFetcher, opts ...SRIOption) Config {
+	var o sriOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	addAttrs := func(attrs map[string]string) ([]string, error) {
+		if _, ok := attrs["integrity"]; ok {
+			// The tag already specifies its own integrity hash. AddAttributesFunc's
+			// output is inserted right after the tag name, before the tag's existing
+			// attributes, and HTML parsers keep only the first occurrence of a
+			// duplicate attribute, so adding ours here would silently discard the
+			// author's hash in favor of the library's.
+			return nil, nil
+		}
+		url, ok := sriResourceURL(attrs)
+		if !ok {
+			return nil, nil
+		}
+		hash, ok := fetcher.Hash(url)
+		if !ok {
+			if o.failOnMissingHash {
+				return nil, fmt.Errorf("htmlinject: SRI: no integrity hash available for %q", url)
+			}
+			return nil, nil
+		}
+		out := []string{fmt.Sprintf(` integrity=%q`, hash)}
+		if _, ok := attrs["crossorigin"]; !ok {
+			out = append(out, ` crossorigin="anonymous"`)
+		}
+		return out, nil
+	}
+
+	return Config{
+		Rule{
+			Name:              "SRI for scripts",
+			Selector:          `script[src]`,
+			AddAttributesFunc: addAttrs,
+		},
+		Rule{
+			Name:              "SRI for stylesheets",
+			Selector:          `link[rel="stylesheet"][href]`,
+			AddAttributesFunc: addAttrs,
+		},
+		Rule{
+			Name:              "SRI for preloaded scripts",
+			Selector:          `link[rel="preload"][as="script"][href]`,
+			AddAttributesFunc: addAttrs,
+		},
+		Rule{
+			Name:              "SRI for preloaded styles",
+			Selector:          `link[rel="preload"][as="style"][href]`,
+			AddAttributesFunc: addAttrs,
+		},
+	}
+}
+
+// sriResourceURL returns the resource URL a tag's SRI hash should be looked
+// up by: a script's src, or a link's href.
+func sriResourceURL(attrs map[string]string) (string, bool) {
+	if v, ok := attrs["src"]; ok {
+		return v, true
+	}
+	if v, ok := attrs["href"]; ok {
+		return v, true
+	}
+	return "", false
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htmlinject
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSRI(t *testing.T) {
+	tests := []struct {
+		name    string
+		fetcher SRIFetcher
+		opts    []SRIOption
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "preload as=style",
+			fetcher: SRIManifest{"styles.css": "sha384-def"},
+			in:      `<link rel="preload" as="style" href="styles.css">`,
+			want:    `<link integrity="sha384-def" crossorigin="anonymous" rel="preload" as="style" href="styles.css">`,
+		},
+		{
+			name:    "missing hash left untouched by default",
+			fetcher: SRIManifest{},
+			in:      `<script src="app.js"></script>`,
+			want:    `<script src="app.js"></script>`,
+		},
+		{
+			name:    "SRIFailOnMissingHash fails the transform",
+			fetcher: SRIManifest{},
+			opts:    []SRIOption{SRIFailOnMissingHash()},
+			in:      `<script src="app.js"></script>`,
+			wantErr: true,
+		},
+		{
+			name:    "SRIResolverFunc",
+			fetcher: SRIResolverFunc(func(url string) (string, bool) { return "sha384-" + url, true }),
+			in:      `<script src="app.js"></script>`,
+			want:    `<script integrity="sha384-app.js" crossorigin="anonymous" src="app.js"></script>`,
+		},
+		{
+			// Regression test: a tag that already specifies its own
+			// integrity/crossorigin must not get them duplicated, since
+			// HTML parsers keep only the first occurrence and the author's
+			// values would be silently discarded.
+			name:    "existing integrity is left alone, not duplicated",
+			fetcher: SRIManifest{"app.js": "sha384-abc"},
+			in:      `<script src="app.js" integrity="sha384-existing" crossorigin="use-credentials"></script>`,
+			want:    `<script src="app.js" integrity="sha384-existing" crossorigin="use-credentials"></script>`,
+		},
+		{
+			name:    "existing crossorigin without integrity is preserved",
+			fetcher: SRIManifest{"app.js": "sha384-abc"},
+			in:      `<script src="app.js" crossorigin="use-credentials"></script>`,
+			want:    `<script integrity="sha384-abc" src="app.js" crossorigin="use-credentials"></script>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Transform(strings.NewReader(tt.in), SRI(tt.fetcher, tt.opts...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transform: got err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("-want +got %s", diff)
+			}
+		})
+	}
+}
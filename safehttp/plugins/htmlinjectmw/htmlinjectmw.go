@@ -0,0 +1,217 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package htmlinjectmw applies htmlinject Rules to text/html response bodies
+// on the fly, without requiring the response to be rendered through
+// html/template. This makes htmlinject usable in front of static files,
+// reverse-proxied upstreams, or any other handler that writes HTML directly.
+package htmlinjectmw
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-safeweb/safehttp/plugins/htmlinject"
+)
+
+// sniffLen mirrors net/http's own content-type sniffing buffer size, so the
+// decision of whether to rewrite a response costs no more memory than the
+// standard library already spends deciding Content-Type.
+const sniffLen = 512
+
+// NonceFunc returns the CSP nonce for the given request context. It's meant to
+// be backed by whatever the CSP plugin stashed in the context for this
+// request, rather than a html/template FuncMap, since responses wrapped by
+// this package are never executed as templates.
+type NonceFunc func(ctx context.Context) string
+
+// TokenFunc returns the anti-XSRF token for the given request context,
+// analogous to NonceFunc but for the xsrf plugin.
+type TokenFunc func(ctx context.Context) string
+
+// Config configures Wrap.
+type Config struct {
+	// Rules are additional htmlinject Configs to apply to every text/html response.
+	Rules []htmlinject.Config
+	// Options are extra htmlinject.TransformOptions, e.g. htmlinject.Minify.
+	Options []htmlinject.TransformOption
+	// Nonce, if set, injects CSP nonces using htmlinject.CSPNonces with the
+	// value it returns, instead of requiring a {{CSPNonce}} template action.
+	Nonce NonceFunc
+	// Token, if set, injects anti-XSRF hidden inputs using htmlinject.XSRFTokens
+	// with the value it returns, instead of requiring a {{XSRFToken}} template action.
+	Token TokenFunc
+	// OnError, if set, is called with any error returned by htmlinject.TransformTo,
+	// e.g. from a Rule's AddAttributesFunc failing partway through the response
+	// body. By the time it's called the response has already been partially
+	// written to the client, so there's nothing left for Wrap to do but report
+	// it; OnError is the caller's hook to log or alert on it. If nil, such
+	// errors are silently dropped.
+	OnError func(error)
+}
+
+// Wrap returns an http.Handler that rewrites any text/html response body
+// produced by next according to cfg, streaming rewritten bytes to the client
+// as they're produced instead of buffering the whole response. Responses
+// whose Content-Type isn't text/html are passed through untouched.
+func Wrap(next http.Handler, cfg Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w, cfg: cfg, ctx: r.Context()}
+		// defer, rather than a plain call after ServeHTTP, so that a handler
+		// that panics after starting the background rewrite still closes
+		// pw/pr and drains rw.done instead of leaking the goroutine forever.
+		defer rw.finish()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// responseWriter buffers up to sniffLen bytes to decide whether the response
+// is HTML, then either passes writes through untouched or streams them
+// through htmlinject.TransformTo over an io.Pipe.
+type responseWriter struct {
+	http.ResponseWriter
+	cfg Config
+	ctx context.Context
+
+	statusCode  int
+	decided     bool
+	passthrough bool
+	sniff       []byte
+
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.statusCode == 0 {
+		rw.statusCode = code
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+	if rw.decided {
+		if rw.passthrough {
+			return rw.ResponseWriter.Write(p)
+		}
+		return rw.pw.Write(p)
+	}
+
+	// Only ever copy enough of p into rw.sniff to reach sniffLen, even if p
+	// itself is much larger: a handler that renders the whole page in one
+	// w.Write call must not end up fully buffered in memory before decide()
+	// runs, which would defeat the point of streaming.
+	n := sniffLen - len(rw.sniff)
+	if n > len(p) {
+		n = len(p)
+	}
+	rw.sniff = append(rw.sniff, p[:n]...)
+	if len(rw.sniff) < sniffLen {
+		return len(p), nil
+	}
+	rw.decide()
+
+	rest := p[n:]
+	if len(rest) == 0 {
+		return len(p), nil
+	}
+	if rw.passthrough {
+		if _, err := rw.ResponseWriter.Write(rest); err != nil {
+			return n, err
+		}
+		return len(p), nil
+	}
+	if _, err := rw.pw.Write(rest); err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
+
+// decide picks Content-Type (sniffing the buffered prefix if the handler
+// hasn't set one), flushes the real status line and headers downstream, and
+// either writes the buffered prefix through untouched or starts the
+// background rewrite of it plus everything that follows.
+func (rw *responseWriter) decide() {
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+	ct := rw.Header().Get("Content-Type")
+	if ct == "" {
+		ct = http.DetectContentType(rw.sniff)
+		rw.Header().Set("Content-Type", ct)
+	}
+	rw.passthrough = !strings.HasPrefix(ct, "text/html")
+
+	if rw.passthrough {
+		rw.ResponseWriter.WriteHeader(rw.statusCode)
+		rw.ResponseWriter.Write(rw.sniff)
+		rw.decided = true
+		rw.sniff = nil
+		return
+	}
+
+	// The rewritten body's length isn't known up front.
+	rw.Header().Del("Content-Length")
+	rw.ResponseWriter.WriteHeader(rw.statusCode)
+
+	pr, pw := io.Pipe()
+	rw.pw = pw
+	rw.done = make(chan error, 1)
+	go func() {
+		_, err := htmlinject.TransformTo(rw.ResponseWriter, pr, rw.options()...)
+		pr.CloseWithError(err)
+		rw.done <- err
+	}()
+	rw.pw.Write(rw.sniff)
+	rw.decided = true
+	rw.sniff = nil
+}
+
+// finish must run once the wrapped handler has returned: it flushes any
+// buffered-but-undecided bytes and waits for the background rewrite, if any,
+// to drain.
+func (rw *responseWriter) finish() {
+	if !rw.decided {
+		rw.decide()
+	}
+	if rw.pw == nil {
+		return
+	}
+	rw.pw.Close()
+	if err := <-rw.done; err != nil && rw.cfg.OnError != nil {
+		rw.cfg.OnError(err)
+	}
+}
+
+// options builds the per-request TransformOptions: nonce/token rules built
+// from cfg.Nonce/cfg.Token come first so AddAttributes ordering matches
+// htmlinject.CSPNoncesDefault/XSRFTokensDefault, followed by cfg.Rules and cfg.Options.
+func (rw *responseWriter) options() []htmlinject.TransformOption {
+	var opts []htmlinject.TransformOption
+	if rw.cfg.Nonce != nil {
+		opts = append(opts, htmlinject.CSPNonces(fmt.Sprintf("nonce=%q", rw.cfg.Nonce(rw.ctx))))
+	}
+	if rw.cfg.Token != nil {
+		opts = append(opts, htmlinject.XSRFTokens(fmt.Sprintf(`<input type="hidden" name="xsrf-token" value=%q>`, rw.cfg.Token(rw.ctx))))
+	}
+	for _, c := range rw.cfg.Rules {
+		opts = append(opts, c)
+	}
+	return append(opts, rw.cfg.Options...)
+}
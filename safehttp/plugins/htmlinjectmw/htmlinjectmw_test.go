@@ -0,0 +1,198 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package htmlinjectmw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-safeweb/safehttp/plugins/htmlinject"
+)
+
+func TestWrapHTML(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<script>alert("hi")</script><form></form>`))
+	})
+	cfg := Config{
+		Nonce: func(ctx context.Context) string { return "nonce-secret" },
+		Token: func(ctx context.Context) string { return "token-secret" },
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	Wrap(next, cfg).ServeHTTP(rec, req)
+
+	want := `<script nonce="nonce-secret">alert("hi")</script><form><input type="hidden" name="xsrf-token" value="token-secret"></form>`
+	if diff := cmp.Diff(want, rec.Body.String()); diff != "" {
+		t.Errorf("body: -want +got %s", diff)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "" {
+		t.Errorf("Content-Length: got %q, want it to be absent after rewriting", got)
+	}
+}
+
+func TestWrapSurfacesTransformError(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<script src="app.js"></script>`))
+	})
+	var gotErr error
+	cfg := Config{
+		Rules: []htmlinject.Config{htmlinject.SRI(htmlinject.SRIManifest{}, htmlinject.SRIFailOnMissingHash())},
+		OnError: func(err error) {
+			gotErr = err
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	Wrap(next, cfg).ServeHTTP(rec, req)
+
+	if gotErr == nil {
+		t.Fatal("OnError: got no error, want one from the missing SRI hash")
+	}
+}
+
+func TestWrapNonHTMLPassesThrough(t *testing.T) {
+	const body = `{"ok":true}`
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	Wrap(next, Config{}).ServeHTTP(rec, req)
+
+	if diff := cmp.Diff(body, rec.Body.String()); diff != "" {
+		t.Errorf("body: -want +got %s", diff)
+	}
+}
+
+func TestWrapSniffsContentTypeWhenUnset(t *testing.T) {
+	const body = `<!DOCTYPE html><script>alert("hi")</script>`
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Deliberately not setting Content-Type, forcing decide() to sniff it
+		// from the buffered prefix via http.DetectContentType.
+		w.Write([]byte(body))
+	})
+	cfg := Config{
+		Nonce: func(ctx context.Context) string { return "nonce-secret" },
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	Wrap(next, cfg).ServeHTTP(rec, req)
+
+	want := `<!DOCTYPE html><script nonce="nonce-secret">alert("hi")</script>`
+	if diff := cmp.Diff(want, rec.Body.String()); diff != "" {
+		t.Errorf("body: -want +got %s", diff)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type: got %q, want a sniffed text/html", got)
+	}
+}
+
+func TestWrapHandlesBodyStraddlingSniffBoundary(t *testing.T) {
+	// Padding long enough that the <script> tag lands after sniffLen bytes
+	// have already been buffered and decide() has run, exercising the
+	// pipe-streaming path rather than the single decide()-time write.
+	padding := strings.Repeat("<!-- filler --> ", 40)
+	if len(padding) <= sniffLen {
+		t.Fatalf("test padding of %d bytes doesn't exceed sniffLen %d", len(padding), sniffLen)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// Write in several small chunks, some landing before and some after
+		// the sniffLen boundary, rather than one big Write call.
+		for _, chunk := range []string{padding[:300], padding[300:], `<script>`, `alert(1)`, `</script>`} {
+			if _, err := w.Write([]byte(chunk)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	})
+	cfg := Config{
+		Nonce: func(ctx context.Context) string { return "nonce-secret" },
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	Wrap(next, cfg).ServeHTTP(rec, req)
+
+	want := padding + `<script nonce="nonce-secret">alert(1)</script>`
+	if diff := cmp.Diff(want, rec.Body.String()); diff != "" {
+		t.Errorf("body: -want +got %s", diff)
+	}
+}
+
+func TestWriteDoesNotBufferEntireLargeSingleWrite(t *testing.T) {
+	const bodySize = 5 * 1024 * 1024 // 5MB, as a single w.Write call.
+	body := `<!DOCTYPE html><script>` + strings.Repeat("a", bodySize) + `</script>`
+
+	rec := httptest.NewRecorder()
+	rw := &responseWriter{ResponseWriter: rec, ctx: context.Background()}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	n, err := rw.Write([]byte(body))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n != len(body) {
+		t.Errorf("Write: got n=%d, want %d", n, len(body))
+	}
+	if !rw.decided {
+		t.Fatal("a single large Write should cross sniffLen and trigger decide() synchronously rather than waiting for finish()")
+	}
+	// Only up to sniffLen bytes should ever be copied into rw.sniff, with the
+	// rest forwarded straight to the passthrough/pipe path; if it grew to
+	// accommodate the whole body, this defeats the point of streaming.
+	if cap(rw.sniff) > 2*sniffLen {
+		t.Errorf("rw.sniff grew to accommodate the full %d-byte write (cap=%d); want it capped near sniffLen=%d", len(body), cap(rw.sniff), sniffLen)
+	}
+
+	rw.finish()
+	if rec.Body.Len() == 0 {
+		t.Fatal("expected a non-empty rewritten response body")
+	}
+}
+
+func TestWrapHandlerPanicDoesNotLeakPipeGoroutine(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<script>alert(1)</script>`))
+		panic("boom")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { recover() }()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		Wrap(next, Config{}).ServeHTTP(rec, req)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeHTTP did not return after handler panic; the io.Pipe goroutine is likely leaked waiting on an unclosed pw/pr")
+	}
+}